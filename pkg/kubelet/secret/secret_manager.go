@@ -17,20 +17,32 @@ limitations under the License.
 package secret
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/golang/glog"
+
 	"k8s.io/kubernetes/pkg/api/v1"
+	authorizationv1 "k8s.io/kubernetes/pkg/apis/authorization/v1"
 	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/clientset"
 	storageetcd "k8s.io/kubernetes/pkg/storage/etcd"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/pkg/util/clock"
+	"k8s.io/client-go/tools/pager"
 )
 
+// defaultPrefetchChunkSize is the page size used by PrefetchNamespaces when
+// paging through a namespace's secrets.
+const defaultPrefetchChunkSize = 500
+
 type Manager interface {
 	// Get secret by secret namespace and name.
 	GetSecret(namespace, name string) (*v1.Secret, error)
@@ -44,6 +56,31 @@ type Manager interface {
 	// UnregisterPod unregisters secrets from a given pod that are not
 	// used by any other registered pod.
 	UnregisterPod(pod *v1.Pod)
+
+	// Subscribe registers handler to be called whenever the cached value of
+	// the given secret changes: with (nil, secret) the first time it is
+	// observed, (old, new) on every subsequent change, and (old, nil) once
+	// the secret is observed to be deleted. The returned func removes the
+	// subscription. Handlers are invoked outside of the manager's internal
+	// locks, so they may safely call back into the Manager.
+	Subscribe(namespace, name string, handler func(old, new *v1.Secret)) (unsubscribe func())
+
+	// GetSecretHash returns a stable hash over the given secret's Type and
+	// contents (but not its metadata), so callers can cheaply tell whether a
+	// secret has meaningfully changed without comparing the full object.
+	GetSecretHash(namespace, name string) (string, error)
+
+	// PrefetchNamespaces warms the cache for every already-registered secret
+	// in the given namespaces via a paginated List, rather than waiting for
+	// each secret to be fetched individually on first GetSecret. It never
+	// registers secrets that RegisterPod has not been called for.
+	PrefetchNamespaces(ctx context.Context, namespaces []string) error
+
+	// CheckAccess reports whether this kubelet's credentials are allowed to
+	// get and/or watch the given secret, via a SelfSubjectAccessReview. It is
+	// meant to turn an opaque Forbidden error from GetSecret into an
+	// actionable one logged once, up front, when the secret is registered.
+	CheckAccess(ctx context.Context, namespace, name string) (canGet, canWatch bool, err error)
 }
 
 // simpleSecretManager implements SecretManager interfaces with
@@ -66,6 +103,129 @@ func (s *simpleSecretManager) RegisterPod(pod *v1.Pod) {
 func (s *simpleSecretManager) UnregisterPod(pod *v1.Pod) {
 }
 
+// Subscribe is a no-op for simpleSecretManager: it does not cache secrets,
+// so there is no local state whose changes could be observed.
+func (s *simpleSecretManager) Subscribe(namespace, name string, handler func(old, new *v1.Secret)) func() {
+	return func() {}
+}
+
+func (s *simpleSecretManager) GetSecretHash(namespace, name string) (string, error) {
+	secret, err := s.GetSecret(namespace, name)
+	if err != nil {
+		return "", err
+	}
+	return computeSecretHash(secret), nil
+}
+
+// PrefetchNamespaces is a no-op for simpleSecretManager: it does not cache
+// secrets, so there is nothing to warm up.
+func (s *simpleSecretManager) PrefetchNamespaces(ctx context.Context, namespaces []string) error {
+	return nil
+}
+
+// CheckAccess is not cached by simpleSecretManager, since it does not cache
+// anything else either; every call hits the apiserver directly.
+func (s *simpleSecretManager) CheckAccess(ctx context.Context, namespace, name string) (bool, bool, error) {
+	return checkSecretAccess(s.kubeClient, namespace, name)
+}
+
+// checkSecretAccess reports whether the caller's credentials allow get and
+// watch access to the secret namespace/name, via a SelfSubjectAccessReview.
+func checkSecretAccess(kubeClient clientset.Interface, namespace, name string) (canGet, canWatch bool, err error) {
+	canGet, err = checkSecretVerb(kubeClient, namespace, name, "get")
+	if err != nil {
+		return false, false, err
+	}
+	canWatch, err = checkSecretVerb(kubeClient, namespace, name, "watch")
+	if err != nil {
+		return canGet, false, err
+	}
+	return canGet, canWatch, nil
+}
+
+func checkSecretVerb(kubeClient clientset.Interface, namespace, name, verb string) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Resource:  "secrets",
+				Name:      name,
+			},
+		},
+	}
+	result, err := kubeClient.Authorization().SelfSubjectAccessReviews().Create(review)
+	if err != nil {
+		return false, err
+	}
+	return result.Status.Allowed, nil
+}
+
+// accessCacheTTL bounds how long a CheckAccess result is reused before being
+// re-checked, so that RBAC changes (e.g. a tightened role) are picked up
+// without requiring a kubelet restart.
+const accessCacheTTL = 30 * time.Second
+
+// accessCacheItem is the cached CheckAccess outcome for a single secret.
+type accessCacheItem struct {
+	sync.Mutex
+
+	checked          bool
+	canGet, canWatch bool
+	err              error
+	checkedAt        time.Time
+}
+
+// accessCache memoizes CheckAccess results per secret with a short TTL.
+type accessCache struct {
+	kubeClient clientset.Interface
+	clock      clock.Clock
+	ttl        time.Duration
+
+	lock  sync.Mutex
+	items map[objectKey]*accessCacheItem
+}
+
+func newAccessCache(kubeClient clientset.Interface, clock clock.Clock, ttl time.Duration) *accessCache {
+	return &accessCache{
+		kubeClient: kubeClient,
+		clock:      clock,
+		ttl:        ttl,
+		items:      make(map[objectKey]*accessCacheItem),
+	}
+}
+
+func (a *accessCache) check(namespace, name string) (canGet, canWatch bool, err error) {
+	key := objectKey{namespace: namespace, name: name}
+
+	a.lock.Lock()
+	item, exists := a.items[key]
+	if !exists {
+		item = &accessCacheItem{}
+		a.items[key] = item
+	}
+	a.lock.Unlock()
+
+	item.Lock()
+	defer item.Unlock()
+	if !item.checked || !a.clock.Now().Before(item.checkedAt.Add(a.ttl)) {
+		item.canGet, item.canWatch, item.err = checkSecretAccess(a.kubeClient, namespace, name)
+		item.checkedAt = a.clock.Now()
+		item.checked = true
+	}
+	return item.canGet, item.canWatch, item.err
+}
+
+// invalidate drops any cached result for namespace/name, so the next check
+// hits the apiserver again instead of reusing a result for a secret that is
+// no longer registered.
+func (a *accessCache) invalidate(namespace, name string) {
+	key := objectKey{namespace: namespace, name: name}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.items, key)
+}
+
 type objectKey struct {
 	namespace string
 	name      string
@@ -81,10 +241,70 @@ type secretData struct {
 	sync.Mutex
 
 	secret         *v1.Secret
+	hash           string
 	err            error
 	lastUpdateTime time.Time
 }
 
+// secretSubscription is a single Subscribe() registration.
+type secretSubscription struct {
+	id      int64
+	handler func(old, new *v1.Secret)
+}
+
+// subscriberRegistry tracks Subscribe() handlers per (namespace, name) key
+// and dispatches change notifications to them. It is shared by secretStore
+// and watchingSecretManager so both Manager implementations get identical
+// Subscribe/notify semantics instead of maintaining independent copies that
+// can drift apart.
+type subscriberRegistry struct {
+	lock           sync.Mutex
+	subscribers    map[objectKey][]*secretSubscription
+	nextSubscriber int64
+}
+
+func newSubscriberRegistry() *subscriberRegistry {
+	return &subscriberRegistry{subscribers: make(map[objectKey][]*secretSubscription)}
+}
+
+// subscribe registers handler to be notified about changes to key and
+// returns a func that removes the subscription.
+func (r *subscriberRegistry) subscribe(key objectKey, handler func(old, new *v1.Secret)) func() {
+	r.lock.Lock()
+	r.nextSubscriber++
+	id := r.nextSubscriber
+	r.subscribers[key] = append(r.subscribers[key], &secretSubscription{id: id, handler: handler})
+	r.lock.Unlock()
+
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		subs := r.subscribers[key]
+		for i, sub := range subs {
+			if sub.id == id {
+				r.subscribers[key] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(r.subscribers[key]) == 0 {
+			delete(r.subscribers, key)
+		}
+	}
+}
+
+// notify invokes every handler registered for key with old and new. It must
+// not be called with secretStore.lock, watchingSecretManager.lock or a
+// secretData lock held.
+func (r *subscriberRegistry) notify(key objectKey, old, new *v1.Secret) {
+	r.lock.Lock()
+	subs := append([]*secretSubscription(nil), r.subscribers[key]...)
+	r.lock.Unlock()
+
+	for _, sub := range subs {
+		sub.handler(old, new)
+	}
+}
+
 // secretStore is a local cache of secrets.
 type secretStore struct {
 	kubeClient clientset.Interface
@@ -93,6 +313,8 @@ type secretStore struct {
 	lock  sync.Mutex
 	items map[objectKey]*secretStoreItem
 	ttl   time.Duration
+
+	subs *subscriberRegistry
 }
 
 func newSecretStore(kubeClient clientset.Interface, clock clock.Clock, ttl time.Duration) *secretStore {
@@ -101,16 +323,31 @@ func newSecretStore(kubeClient clientset.Interface, clock clock.Clock, ttl time.
 		clock:      clock,
 		items:      make(map[objectKey]*secretStoreItem),
 		ttl:        ttl,
+		subs:       newSubscriberRegistry(),
 	}
 }
 
+// subscribe registers handler to be notified about changes to namespace/name
+// and returns a func that removes the subscription.
+func (s *secretStore) subscribe(namespace, name string, handler func(old, new *v1.Secret)) func() {
+	return s.subs.subscribe(objectKey{namespace: namespace, name: name}, handler)
+}
+
+// notifySubscribers invokes every handler registered for key with old and
+// new. It must not be called with s.lock or a secretData lock held.
+func (s *secretStore) notifySubscribers(key objectKey, old, new *v1.Secret) {
+	s.subs.notify(key, old, new)
+}
+
 func isSecretOlder(newSecret, oldSecret *v1.Secret) bool {
 	newVersion, _ := storageetcd.Versioner.ObjectResourceVersion(newSecret)
 	oldVersion, _ := storageetcd.Versioner.ObjectResourceVersion(oldSecret)
 	return newVersion < oldVersion
 }
 
-func (s *secretStore) Add(namespace, name string) {
+// Add increases the refCount of namespace/name, creating it if necessary,
+// and reports whether this call was the one that created it.
+func (s *secretStore) Add(namespace, name string) bool {
 	key := objectKey{namespace: namespace, name: name}
 
 	// Add is called from RegisterPod, thus it needs to be efficient.
@@ -130,19 +367,26 @@ func (s *secretStore) Add(namespace, name string) {
 	item.refCount++
 	// This will trigger fetch on the next Get() operation.
 	item.secret = nil
+	return !exists
 }
 
-func (s *secretStore) Delete(namespace, name string) {
+// Delete decreases the refCount of namespace/name and reports whether this
+// call was the one that dropped it to zero, removing the entry.
+func (s *secretStore) Delete(namespace, name string) bool {
 	key := objectKey{namespace: namespace, name: name}
 
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if item, ok := s.items[key]; ok {
-		item.refCount--
-		if item.refCount == 0 {
-			delete(s.items, key)
-		}
+	item, ok := s.items[key]
+	if !ok {
+		return false
 	}
+	item.refCount--
+	if item.refCount > 0 {
+		return false
+	}
+	delete(s.items, key)
+	return true
 }
 
 func (s *secretStore) Get(namespace, name string) (*v1.Secret, error) {
@@ -167,23 +411,157 @@ func (s *secretStore) Get(namespace, name string) (*v1.Secret, error) {
 	// After updating data in secretStore, lock the data, fetch secret if
 	// needed and return data.
 	data.Lock()
-	defer data.Unlock()
+	var oldSecret, newSecret *v1.Secret
+	notify := false
 	if data.err != nil || !s.clock.Now().Before(data.lastUpdateTime.Add(s.ttl)) {
 		secret, err := s.kubeClient.Core().Secrets(namespace).Get(name, metav1.GetOptions{})
 		// Update state, unless we got error different than "not-found".
 		if err == nil || apierrors.IsNotFound(err) {
 			// Ignore the update to the older version of a secret.
 			if data.secret == nil || secret == nil || !isSecretOlder(secret, data.secret) {
+				newHash := computeSecretHash(secret)
+				// A newer resourceVersion doesn't necessarily mean the
+				// content consumers care about actually changed (e.g. an
+				// unrelated annotation update). Only treat it as a change -
+				// and notify subscribers - when the hash differs.
+				if (data.secret != nil || secret != nil) && (data.secret == nil || secret == nil || newHash != data.hash) {
+					oldSecret, newSecret = data.secret, secret
+					notify = true
+				}
 				data.secret = secret
+				data.hash = newHash
 				data.err = err
 				data.lastUpdateTime = s.clock.Now()
 			}
 		} else if data.secret == nil && data.err == nil {
 			// We have unitialized secretData - return current result.
+			data.Unlock()
 			return secret, err
 		}
 	}
-	return data.secret, data.err
+	result, resultErr := data.secret, data.err
+	data.Unlock()
+
+	if notify {
+		s.notifySubscribers(key, oldSecret, newSecret)
+	}
+	return result, resultErr
+}
+
+// GetHash returns the content hash most recently computed for namespace/name,
+// fetching the secret first if the cache entry is stale or absent.
+func (s *secretStore) GetHash(namespace, name string) (string, error) {
+	if _, err := s.Get(namespace, name); err != nil {
+		return "", err
+	}
+
+	key := objectKey{namespace: namespace, name: name}
+	s.lock.Lock()
+	item, exists := s.items[key]
+	s.lock.Unlock()
+	if !exists || item.secret == nil {
+		return "", fmt.Errorf("secret %q/%q not registered", namespace, name)
+	}
+
+	item.secret.Lock()
+	defer item.secret.Unlock()
+	return item.secret.hash, item.secret.err
+}
+
+// prefetch pages through every secret in namespace and seeds the cache entry
+// of each one that is already registered. A page-read failure part-way
+// through leaves every entry seeded so far intact and simply leaves the rest
+// to be fetched individually by a later Get(), so the store never ends up
+// partially updated for a single key.
+func (s *secretStore) prefetch(ctx context.Context, namespace string) error {
+	listPager := pager.New(pager.SimplePageFunc(func(opts metav1.ListOptions) (runtime.Object, error) {
+		return s.kubeClient.Core().Secrets(namespace).List(opts)
+	}))
+	listPager.PageSize = defaultPrefetchChunkSize
+
+	now := s.clock.Now()
+	return listPager.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+		secret, ok := obj.(*v1.Secret)
+		if !ok {
+			return fmt.Errorf("unexpected object type %T from secret list", obj)
+		}
+		s.seed(namespace, secret, now)
+		return nil
+	})
+}
+
+// seed populates the cache entry for namespace/secret.Name with secret, but
+// only if Add has already created that entry (i.e. some pod referencing it
+// is already registered) - it never creates new entries on its own. Like
+// Get, it notifies subscribers when this is the first observation of the
+// secret or its content actually changed.
+func (s *secretStore) seed(namespace string, secret *v1.Secret, now time.Time) {
+	key := objectKey{namespace: namespace, name: secret.Name}
+
+	s.lock.Lock()
+	item, exists := s.items[key]
+	if exists && item.secret == nil {
+		item.secret = &secretData{}
+	}
+	s.lock.Unlock()
+	if !exists {
+		return
+	}
+
+	data := item.secret
+	data.Lock()
+	var oldSecret *v1.Secret
+	notify := false
+	if data.secret == nil || !isSecretOlder(secret, data.secret) {
+		newHash := computeSecretHash(secret)
+		if data.secret == nil || newHash != data.hash {
+			oldSecret = data.secret
+			notify = true
+		}
+		data.secret = secret
+		data.hash = newHash
+		data.err = nil
+		data.lastUpdateTime = now
+	}
+	data.Unlock()
+
+	if notify {
+		s.notifySubscribers(key, oldSecret, secret)
+	}
+}
+
+// computeSecretHash returns a stable hash over the parts of a secret that
+// its consumers actually observe - Type, Data and StringData - so that
+// metadata-only updates (e.g. annotations, label churn, or unrelated
+// resourceVersion bumps) can be told apart from real content changes.
+// It returns the empty string for a nil secret.
+func computeSecretHash(secret *v1.Secret) string {
+	if secret == nil {
+		return ""
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "type:%s\n", secret.Type)
+
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "data:%s=%x\n", key, secret.Data[key])
+	}
+
+	keys = keys[:0]
+	for key := range secret.StringData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "stringData:%s=%s\n", key, secret.StringData[key])
+	}
+
+	return fmt.Sprintf("%x", h.Sum64())
 }
 
 // cachingSecretManager keeps a cache of all secrets necessary for registered pods.
@@ -195,6 +573,7 @@ func (s *secretStore) Get(namespace, name string) (*v1.Secret, error) {
 //   value in cache; otherwise it is just fetched from cache
 type cachingSecretManager struct {
 	secretStore *secretStore
+	accessCache *accessCache
 
 	lock           sync.Mutex
 	registeredPods map[objectKey]*v1.Pod
@@ -203,6 +582,7 @@ type cachingSecretManager struct {
 func NewCachingSecretManager(kubeClient clientset.Interface) (Manager, error) {
 	csm := &cachingSecretManager{
 		secretStore:    newSecretStore(kubeClient, clock.RealClock{}, time.Minute),
+		accessCache:    newAccessCache(kubeClient, clock.RealClock{}, accessCacheTTL),
 		registeredPods: make(map[objectKey]*v1.Pod),
 	}
 	return csm, nil
@@ -212,29 +592,101 @@ func (c *cachingSecretManager) GetSecret(namespace, name string) (*v1.Secret, er
 	return c.secretStore.Get(namespace, name)
 }
 
-// TODO: Before we will use secretManager in other places (e.g. for secret volumes)
-// we should update this function to also get secrets from those places.
+func (c *cachingSecretManager) Subscribe(namespace, name string, handler func(old, new *v1.Secret)) func() {
+	return c.secretStore.subscribe(namespace, name, handler)
+}
+
+func (c *cachingSecretManager) GetSecretHash(namespace, name string) (string, error) {
+	return c.secretStore.GetHash(namespace, name)
+}
+
+func (c *cachingSecretManager) PrefetchNamespaces(ctx context.Context, namespaces []string) error {
+	for _, namespace := range namespaces {
+		if err := c.secretStore.prefetch(ctx, namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cachingSecretManager) CheckAccess(ctx context.Context, namespace, name string) (bool, bool, error) {
+	return c.accessCache.check(namespace, name)
+}
+
+// logAccessProblem runs a CheckAccess for namespace/name in the background
+// and logs an actionable message if it turns out the kubelet cannot get it,
+// so pod sync doesn't just see a bare Forbidden error from GetSecret later.
+func logAccessProblem(accessCache *accessCache, namespace, name string) {
+	go func() {
+		canGet, _, err := accessCache.check(namespace, name)
+		if err != nil {
+			glog.Errorf("checking access to secret %q/%q: %v", namespace, name, err)
+			return
+		}
+		if !canGet {
+			glog.Errorf("service account cannot get/watch secret %q in namespace %q", name, namespace)
+		}
+	}()
+}
+
+// getSecretNames returns the names of every secret referenced by pod, across
+// image pull secrets, secret and projected volumes, and container (including
+// init container) Env and EnvFrom.
 func getSecretNames(pod *v1.Pod) sets.String {
 	result := sets.NewString()
 	for _, reference := range pod.Spec.ImagePullSecrets {
 		result.Insert(reference.Name)
 	}
+
+	for i := range pod.Spec.Volumes {
+		addVolumeSecretNames(result, &pod.Spec.Volumes[i])
+	}
+
+	for i := range pod.Spec.InitContainers {
+		addContainerSecretNames(result, pod.Spec.InitContainers[i].Env, pod.Spec.InitContainers[i].EnvFrom)
+	}
 	for i := range pod.Spec.Containers {
-		for _, envVar := range pod.Spec.Containers[i].Env {
-			if envVar.ValueFrom != nil && envVar.ValueFrom.SecretKeyRef != nil {
-				result.Insert(envVar.ValueFrom.SecretKeyRef.Name)
-			}
-		}
+		addContainerSecretNames(result, pod.Spec.Containers[i].Env, pod.Spec.Containers[i].EnvFrom)
 	}
+
 	return result
 }
 
+func addVolumeSecretNames(result sets.String, volume *v1.Volume) {
+	if volume.Secret != nil {
+		result.Insert(volume.Secret.SecretName)
+	}
+	if volume.Projected == nil {
+		return
+	}
+	for _, source := range volume.Projected.Sources {
+		if source.Secret != nil {
+			result.Insert(source.Secret.Name)
+		}
+	}
+}
+
+func addContainerSecretNames(result sets.String, env []v1.EnvVar, envFrom []v1.EnvFromSource) {
+	for _, envVar := range env {
+		if envVar.ValueFrom != nil && envVar.ValueFrom.SecretKeyRef != nil {
+			result.Insert(envVar.ValueFrom.SecretKeyRef.Name)
+		}
+	}
+	for _, from := range envFrom {
+		if from.SecretRef != nil {
+			result.Insert(from.SecretRef.Name)
+		}
+	}
+}
+
 func (c *cachingSecretManager) RegisterPod(pod *v1.Pod) {
 	names := getSecretNames(pod)
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	for name := range names {
-		c.secretStore.Add(pod.Namespace, name)
+		if c.secretStore.Add(pod.Namespace, name) {
+			logAccessProblem(c.accessCache, pod.Namespace, name)
+		}
 	}
 	var prev *v1.Pod
 	key := objectKey{namespace: pod.Namespace, name: pod.Name}
@@ -242,7 +694,9 @@ func (c *cachingSecretManager) RegisterPod(pod *v1.Pod) {
 	c.registeredPods[key] = pod
 	if prev != nil {
 		for name := range getSecretNames(prev) {
-			c.secretStore.Delete(prev.Namespace, name)
+			if c.secretStore.Delete(prev.Namespace, name) {
+				c.accessCache.invalidate(prev.Namespace, name)
+			}
 		}
 	}
 }
@@ -256,7 +710,9 @@ func (c *cachingSecretManager) UnregisterPod(pod *v1.Pod) {
 	delete(c.registeredPods, key)
 	if prev != nil {
 		for name := range getSecretNames(prev) {
-			c.secretStore.Delete(prev.Namespace, name)
+			if c.secretStore.Delete(prev.Namespace, name) {
+				c.accessCache.invalidate(prev.Namespace, name)
+			}
 		}
 	}
 }
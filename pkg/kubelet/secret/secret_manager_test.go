@@ -0,0 +1,190 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secret
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestComputeSecretHashIgnoresAnnotations(t *testing.T) {
+	a := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"},
+		Type:       v1.SecretTypeOpaque,
+		Data:       map[string][]byte{"key": []byte("value")},
+	}
+	b := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			ResourceVersion: "2",
+			Annotations:     map[string]string{"unrelated": "metadata"},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{"key": []byte("value")},
+	}
+
+	if computeSecretHash(a) != computeSecretHash(b) {
+		t.Errorf("expected hash to ignore resourceVersion/annotations, got %q != %q", computeSecretHash(a), computeSecretHash(b))
+	}
+}
+
+func TestComputeSecretHashIgnoresKeyOrdering(t *testing.T) {
+	a := &v1.Secret{
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{"a": []byte("1"), "b": []byte("2"), "c": []byte("3")},
+	}
+	b := &v1.Secret{
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{"c": []byte("3"), "a": []byte("1"), "b": []byte("2")},
+	}
+
+	if computeSecretHash(a) != computeSecretHash(b) {
+		t.Errorf("expected hash to be independent of map key ordering, got %q != %q", computeSecretHash(a), computeSecretHash(b))
+	}
+}
+
+func TestComputeSecretHashDetectsDataDifferences(t *testing.T) {
+	base := &v1.Secret{
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{"key": []byte("value")},
+	}
+
+	cases := map[string]*v1.Secret{
+		"different value": {
+			Type: v1.SecretTypeOpaque,
+			Data: map[string][]byte{"key": []byte("other")},
+		},
+		"different key": {
+			Type: v1.SecretTypeOpaque,
+			Data: map[string][]byte{"otherKey": []byte("value")},
+		},
+		"different type": {
+			Type: v1.SecretTypeServiceAccountToken,
+			Data: map[string][]byte{"key": []byte("value")},
+		},
+		"stringData instead of data": {
+			Type:       v1.SecretTypeOpaque,
+			StringData: map[string]string{"key": "value"},
+		},
+	}
+
+	baseHash := computeSecretHash(base)
+	for name, other := range cases {
+		if computeSecretHash(other) == baseHash {
+			t.Errorf("%s: expected different hash, got the same %q", name, baseHash)
+		}
+	}
+}
+
+func TestComputeSecretHashNilSecret(t *testing.T) {
+	if got := computeSecretHash(nil); got != "" {
+		t.Errorf("expected empty hash for nil secret, got %q", got)
+	}
+}
+
+func TestGetSecretNames(t *testing.T) {
+	testCases := map[string]struct {
+		pod      *v1.Pod
+		expected sets.String
+	}{
+		"image pull secret": {
+			pod: &v1.Pod{
+				Spec: v1.PodSpec{
+					ImagePullSecrets: []v1.LocalObjectReference{{Name: "pull-secret"}},
+				},
+			},
+			expected: sets.NewString("pull-secret"),
+		},
+		"container env secretKeyRef": {
+			pod: &v1.Pod{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						Env: []v1.EnvVar{{
+							Name:      "FOO",
+							ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "env-secret"}}},
+						}},
+					}},
+				},
+			},
+			expected: sets.NewString("env-secret"),
+		},
+		"init container env secretKeyRef": {
+			pod: &v1.Pod{
+				Spec: v1.PodSpec{
+					InitContainers: []v1.Container{{
+						Env: []v1.EnvVar{{
+							Name:      "FOO",
+							ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "init-env-secret"}}},
+						}},
+					}},
+				},
+			},
+			expected: sets.NewString("init-env-secret"),
+		},
+		"container envFrom secretRef": {
+			pod: &v1.Pod{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{
+						EnvFrom: []v1.EnvFromSource{{SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "envfrom-secret"}}}},
+					}},
+				},
+			},
+			expected: sets.NewString("envfrom-secret"),
+		},
+		"secret volume": {
+			pod: &v1.Pod{
+				Spec: v1.PodSpec{
+					Volumes: []v1.Volume{{
+						VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "volume-secret"}},
+					}},
+				},
+			},
+			expected: sets.NewString("volume-secret"),
+		},
+		"projected volume": {
+			pod: &v1.Pod{
+				Spec: v1.PodSpec{
+					Volumes: []v1.Volume{{
+						VolumeSource: v1.VolumeSource{
+							Projected: &v1.ProjectedVolumeSource{
+								Sources: []v1.VolumeProjection{
+									{Secret: &v1.SecretProjection{LocalObjectReference: v1.LocalObjectReference{Name: "projected-secret"}}},
+								},
+							},
+						},
+					}},
+				},
+			},
+			expected: sets.NewString("projected-secret"),
+		},
+		"no references": {
+			pod:      &v1.Pod{},
+			expected: sets.NewString(),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := getSecretNames(tc.pod); !got.Equal(tc.expected) {
+				t.Errorf("got %v, want %v", got.List(), tc.expected.List())
+			}
+		})
+	}
+}
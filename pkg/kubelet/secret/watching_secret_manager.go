@@ -0,0 +1,464 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secret
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/clientset"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/pkg/util/clock"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/pager"
+)
+
+// secretReflector keeps a single secret up to date via a Reflector watching
+// just that object (a field selector on metadata.name), and is shared via
+// watchingSecretManager.reflectors by all registered pods that reference the
+// same (namespace, name).
+type secretReflector struct {
+	namespace string
+	name      string
+
+	refCount int
+
+	store     cache.Store
+	reflector *cache.Reflector
+	stopCh    chan struct{} // closed once, when refCount drops to zero
+
+	kubeClient   clientset.Interface
+	resyncPeriod time.Duration
+
+	modeLock   sync.Mutex
+	polling    bool
+	runStopped bool
+	runStopCh  chan struct{} // stops whichever of watch/poll is currently running
+
+	onChange func(old, new *v1.Secret)
+
+	lastLock sync.Mutex
+	last     *v1.Secret
+}
+
+func newSecretReflector(kubeClient clientset.Interface, namespace, name string, resyncPeriod time.Duration, onChange func(old, new *v1.Secret)) *secretReflector {
+	r := &secretReflector{
+		namespace:    namespace,
+		name:         name,
+		kubeClient:   kubeClient,
+		resyncPeriod: resyncPeriod,
+		stopCh:       make(chan struct{}),
+		runStopCh:    make(chan struct{}),
+		onChange:     onChange,
+	}
+
+	selector := fields.OneTermEqualSelector("metadata.name", name).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return kubeClient.Core().Secrets(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return kubeClient.Core().Secrets(namespace).Watch(options)
+		},
+	}
+	r.store = &notifyingStore{Store: cache.NewStore(cache.MetaNamespaceKeyFunc), notify: r.notify}
+	r.reflector = cache.NewReflector(lw, &v1.Secret{}, r.store, resyncPeriod)
+	return r
+}
+
+// notify records the latest observed secret and, if it actually differs
+// from what was previously observed, invokes onChange with the old and new
+// values. A nil new value indicates the secret has been deleted.
+func (r *secretReflector) notify(new *v1.Secret) {
+	r.lastLock.Lock()
+	old := r.last
+	r.last = new
+	r.lastLock.Unlock()
+
+	if old == nil && new == nil {
+		return
+	}
+	if old != nil && new != nil && computeSecretHash(old) == computeSecretHash(new) {
+		return
+	}
+	r.onChange(old, new)
+}
+
+func (r *secretReflector) start() {
+	go r.reflector.Run(r.runStopCh)
+}
+
+// stop decrements the refCount and, once it drops to zero, stops whichever
+// of watch/poll is active and reports that the caller should remove it. It
+// is the caller's responsibility to hold the manager's lock while calling
+// this.
+func (r *secretReflector) stop() bool {
+	r.refCount--
+	if r.refCount > 0 {
+		return false
+	}
+	close(r.stopCh)
+	r.modeLock.Lock()
+	r.stopRunLocked()
+	r.modeLock.Unlock()
+	return true
+}
+
+// fallBackToPolling stops the watch-based Reflector and switches to issuing
+// periodic GETs instead, for a secret whose credentials allow get but not
+// watch access. It is a no-op if already polling or already stopped (e.g.
+// the last referring pod was unregistered while the access check that
+// triggers this was still in flight).
+func (r *secretReflector) fallBackToPolling() {
+	r.modeLock.Lock()
+	if r.polling || r.runStopped {
+		r.modeLock.Unlock()
+		return
+	}
+	r.polling = true
+	r.stopRunLocked()
+	r.modeLock.Unlock()
+
+	go r.pollLoop()
+}
+
+// stopRunLocked closes runStopCh exactly once, stopping whichever of
+// watch/poll is currently reading from it. Caller must hold modeLock.
+func (r *secretReflector) stopRunLocked() {
+	if r.runStopped {
+		return
+	}
+	r.runStopped = true
+	close(r.runStopCh)
+}
+
+func (r *secretReflector) pollLoop() {
+	ticker := time.NewTicker(r.resyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+			r.pollOnce()
+		}
+	}
+}
+
+func (r *secretReflector) pollOnce() {
+	secret, err := r.kubeClient.Core().Secrets(r.namespace).Get(r.name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			_ = r.store.Delete(&v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: r.namespace, Name: r.name}})
+		}
+		return
+	}
+	if _, exists, _ := r.store.Get(secret); exists {
+		_ = r.store.Update(secret)
+	} else {
+		_ = r.store.Add(secret)
+	}
+}
+
+// notifyingStore wraps a cache.Store holding a single secret and calls
+// notify with the resulting object on every mutation, so callers can be
+// notified of changes without polling the store themselves. An Add or Update
+// carrying an older resourceVersion than the stored secret is dropped.
+type notifyingStore struct {
+	cache.Store
+	notify func(secret *v1.Secret)
+}
+
+// isStale reports whether obj is older (by isSecretOlder) than the secret
+// already stored under the same key.
+func (s *notifyingStore) isStale(obj interface{}) bool {
+	existing, exists, err := s.Store.Get(obj)
+	if err != nil || !exists {
+		return false
+	}
+	return isSecretOlder(obj.(*v1.Secret), existing.(*v1.Secret))
+}
+
+func (s *notifyingStore) Add(obj interface{}) error {
+	if s.isStale(obj) {
+		return nil
+	}
+	if err := s.Store.Add(obj); err != nil {
+		return err
+	}
+	s.notify(obj.(*v1.Secret))
+	return nil
+}
+
+func (s *notifyingStore) Update(obj interface{}) error {
+	if s.isStale(obj) {
+		return nil
+	}
+	if err := s.Store.Update(obj); err != nil {
+		return err
+	}
+	s.notify(obj.(*v1.Secret))
+	return nil
+}
+
+func (s *notifyingStore) Delete(obj interface{}) error {
+	if err := s.Store.Delete(obj); err != nil {
+		return err
+	}
+	s.notify(nil)
+	return nil
+}
+
+func (s *notifyingStore) Replace(list []interface{}, resourceVersion string) error {
+	if err := s.Store.Replace(list, resourceVersion); err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		s.notify(nil)
+		return nil
+	}
+	s.notify(list[len(list)-1].(*v1.Secret))
+	return nil
+}
+
+// seed primes the reflector's store with secret, letting GetSecret serve it
+// immediately instead of waiting for the reflector's own List/Watch
+// round-trip to complete. Like watch-driven updates, it respects
+// isSecretOlder so a prefetch that lost a race against a newer watch event
+// cannot regress the cached value. It does not affect refCount or lifecycle.
+func (r *secretReflector) seed(secret *v1.Secret) {
+	if obj, exists, err := r.store.GetByKey(r.namespace + "/" + r.name); err == nil && exists {
+		if current, ok := obj.(*v1.Secret); ok && isSecretOlder(secret, current) {
+			return
+		}
+	}
+	_ = r.store.Add(secret)
+}
+
+func (r *secretReflector) get() (*v1.Secret, error) {
+	obj, exists, err := r.store.GetByKey(r.namespace + "/" + r.name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apierrors.NewNotFound(v1.Resource("secret"), r.name)
+	}
+	secret, ok := obj.(*v1.Secret)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T in secret store for %q/%q", obj, r.namespace, r.name)
+	}
+	return secret, nil
+}
+
+// watchingSecretManager keeps a cache of all secrets necessary for registered
+// pods, populated and kept up to date by a per-secret Reflector rather than
+// by a periodic TTL-based fetch. This removes the up-to-ttl staleness window
+// of cachingSecretManager and the repeated apiserver GETs it otherwise incurs
+// for pods that share the same secrets.
+type watchingSecretManager struct {
+	kubeClient   clientset.Interface
+	resyncPeriod time.Duration
+
+	accessCache *accessCache
+
+	lock           sync.Mutex
+	registeredPods map[objectKey]*v1.Pod
+	reflectors     map[objectKey]*secretReflector
+
+	subs *subscriberRegistry
+}
+
+// NewWatchingSecretManager returns a manager which keeps its secret cache
+// fresh via apiserver WATCH events instead of cachingSecretManager's TTL
+// polling. Callers that would otherwise use NewCachingSecretManager can
+// switch to this implementation without any change to the Manager contract.
+func NewWatchingSecretManager(kubeClient clientset.Interface, resyncPeriod time.Duration) Manager {
+	return &watchingSecretManager{
+		kubeClient:     kubeClient,
+		resyncPeriod:   resyncPeriod,
+		accessCache:    newAccessCache(kubeClient, clock.RealClock{}, accessCacheTTL),
+		registeredPods: make(map[objectKey]*v1.Pod),
+		reflectors:     make(map[objectKey]*secretReflector),
+		subs:           newSubscriberRegistry(),
+	}
+}
+
+func (s *watchingSecretManager) CheckAccess(ctx context.Context, namespace, name string) (bool, bool, error) {
+	return s.accessCache.check(namespace, name)
+}
+
+func (s *watchingSecretManager) Subscribe(namespace, name string, handler func(old, new *v1.Secret)) func() {
+	return s.subs.subscribe(objectKey{namespace: namespace, name: name}, handler)
+}
+
+// notifySubscribers invokes every handler registered for key with old and
+// new. It must not be called with s.lock held.
+func (s *watchingSecretManager) notifySubscribers(key objectKey, old, new *v1.Secret) {
+	s.subs.notify(key, old, new)
+}
+
+func (s *watchingSecretManager) GetSecret(namespace, name string) (*v1.Secret, error) {
+	key := objectKey{namespace: namespace, name: name}
+
+	s.lock.Lock()
+	reflector, exists := s.reflectors[key]
+	s.lock.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("secret %q/%q not registered", namespace, name)
+	}
+	return reflector.get()
+}
+
+// PrefetchNamespaces pages through every secret in the given namespaces and
+// seeds the store of every already-registered reflector it finds, so
+// GetSecret can serve those secrets without waiting on each reflector's own
+// List/Watch round-trip. Like secretStore.seed, it never creates a reflector
+// of its own - a secret with no reflector yet is simply skipped, since
+// nothing has called addReflectorLocked (the refCount-tracked equivalent of
+// secretStore.Add) for it and the kubelet has no business caching it.
+func (s *watchingSecretManager) PrefetchNamespaces(ctx context.Context, namespaces []string) error {
+	for _, namespace := range namespaces {
+		if err := s.prefetchNamespace(ctx, namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *watchingSecretManager) prefetchNamespace(ctx context.Context, namespace string) error {
+	listPager := pager.New(pager.SimplePageFunc(func(opts metav1.ListOptions) (runtime.Object, error) {
+		return s.kubeClient.Core().Secrets(namespace).List(opts)
+	}))
+	listPager.PageSize = defaultPrefetchChunkSize
+
+	return listPager.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+		secret, ok := obj.(*v1.Secret)
+		if !ok {
+			return fmt.Errorf("unexpected object type %T from secret list", obj)
+		}
+
+		key := objectKey{namespace: namespace, name: secret.Name}
+		s.lock.Lock()
+		reflector, exists := s.reflectors[key]
+		s.lock.Unlock()
+		if exists {
+			reflector.seed(secret)
+		}
+		return nil
+	})
+}
+
+func (s *watchingSecretManager) GetSecretHash(namespace, name string) (string, error) {
+	secret, err := s.GetSecret(namespace, name)
+	if err != nil {
+		return "", err
+	}
+	return computeSecretHash(secret), nil
+}
+
+func (s *watchingSecretManager) RegisterPod(pod *v1.Pod) {
+	names := getSecretNames(pod)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name := range names {
+		s.addReflectorLocked(pod.Namespace, name)
+	}
+	key := objectKey{namespace: pod.Namespace, name: pod.Name}
+	prev := s.registeredPods[key]
+	s.registeredPods[key] = pod
+	if prev != nil {
+		for name := range getSecretNames(prev) {
+			s.deleteReflectorLocked(prev.Namespace, name)
+		}
+	}
+}
+
+func (s *watchingSecretManager) UnregisterPod(pod *v1.Pod) {
+	key := objectKey{namespace: pod.Namespace, name: pod.Name}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prev := s.registeredPods[key]
+	delete(s.registeredPods, key)
+	if prev != nil {
+		for name := range getSecretNames(prev) {
+			s.deleteReflectorLocked(prev.Namespace, name)
+		}
+	}
+}
+
+// addReflectorLocked must be called with s.lock held.
+func (s *watchingSecretManager) addReflectorLocked(namespace, name string) {
+	key := objectKey{namespace: namespace, name: name}
+	reflector, exists := s.reflectors[key]
+	if !exists {
+		reflector = newSecretReflector(s.kubeClient, namespace, name, s.resyncPeriod, func(old, new *v1.Secret) {
+			s.notifySubscribers(key, old, new)
+		})
+		s.reflectors[key] = reflector
+		reflector.start()
+		s.checkAccessAndMaybeFallBack(namespace, name, reflector)
+	}
+	reflector.refCount++
+}
+
+// checkAccessAndMaybeFallBack runs CheckAccess for namespace/name in the
+// background. It logs an actionable message if the kubelet cannot get the
+// secret at all, and switches reflector from watching to TTL polling if get
+// is allowed but watch is not - rather than looping on watch failures.
+func (s *watchingSecretManager) checkAccessAndMaybeFallBack(namespace, name string, reflector *secretReflector) {
+	go func() {
+		canGet, canWatch, err := s.accessCache.check(namespace, name)
+		if err != nil {
+			glog.Errorf("checking access to secret %q/%q: %v", namespace, name, err)
+			return
+		}
+		if !canGet {
+			glog.Errorf("service account cannot get/watch secret %q in namespace %q", name, namespace)
+			return
+		}
+		if !canWatch {
+			reflector.fallBackToPolling()
+		}
+	}()
+}
+
+// deleteReflectorLocked must be called with s.lock held.
+func (s *watchingSecretManager) deleteReflectorLocked(namespace, name string) {
+	key := objectKey{namespace: namespace, name: name}
+	reflector, exists := s.reflectors[key]
+	if !exists {
+		return
+	}
+	if reflector.stop() {
+		delete(s.reflectors, key)
+		s.accessCache.invalidate(namespace, name)
+	}
+}
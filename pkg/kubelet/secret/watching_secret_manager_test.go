@@ -0,0 +1,154 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secret
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSecretReflectorNotify(t *testing.T) {
+	var calls [][2]*v1.Secret
+	r := newSecretReflector(nil, "ns", "name", time.Minute, func(old, new *v1.Secret) {
+		calls = append(calls, [2]*v1.Secret{old, new})
+	})
+
+	// A nil->nil transition (e.g. a spurious Delete of an already-absent
+	// secret) must not fire a notification.
+	r.notify(nil)
+	if len(calls) != 0 {
+		t.Fatalf("expected no notification for nil->nil, got %v", calls)
+	}
+
+	secretA := &v1.Secret{Type: v1.SecretTypeOpaque, Data: map[string][]byte{"k": []byte("v1")}}
+	r.notify(secretA)
+	if len(calls) != 1 {
+		t.Fatalf("expected a notification for nil->secret, got %d", len(calls))
+	}
+
+	// Same content under a bumped resourceVersion: hash is unchanged, so no
+	// extra notification should fire.
+	secretASameContent := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{ResourceVersion: "2"},
+		Type:       v1.SecretTypeOpaque,
+		Data:       map[string][]byte{"k": []byte("v1")},
+	}
+	r.notify(secretASameContent)
+	if len(calls) != 1 {
+		t.Fatalf("expected no notification for unchanged content, got %d", len(calls))
+	}
+
+	secretB := &v1.Secret{Type: v1.SecretTypeOpaque, Data: map[string][]byte{"k": []byte("v2")}}
+	r.notify(secretB)
+	if len(calls) != 2 {
+		t.Fatalf("expected a notification for changed content, got %d", len(calls))
+	}
+}
+
+func TestNotifyingStoreNotifiesOnMutations(t *testing.T) {
+	var got []*v1.Secret
+	store := &notifyingStore{
+		Store:  cache.NewStore(cache.MetaNamespaceKeyFunc),
+		notify: func(secret *v1.Secret) { got = append(got, secret) },
+	}
+
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name"}}
+	if err := store.Add(secret); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := store.Update(secret); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := store.Delete(secret); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if len(got) != 3 || got[0] != secret || got[1] != secret || got[2] != nil {
+		t.Fatalf("unexpected notifications: %v", got)
+	}
+}
+
+// TestSecretReflectorSeedDoesNotRegressNewerWatchEvent guards against a
+// prefetch losing a race against a newer watch event: seed must not
+// overwrite a secret the reflector has already observed at a higher
+// resourceVersion.
+func TestSecretReflectorSeedDoesNotRegressNewerWatchEvent(t *testing.T) {
+	r := newSecretReflector(nil, "ns", "name", time.Minute, func(old, new *v1.Secret) {})
+
+	newer := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name", ResourceVersion: "5"},
+		Data:       map[string][]byte{"k": []byte("from-watch")},
+	}
+	if err := r.store.Add(newer); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	older := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name", ResourceVersion: "2"},
+		Data:       map[string][]byte{"k": []byte("from-prefetch")},
+	}
+	r.seed(older)
+
+	got, err := r.get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if string(got.Data["k"]) != "from-watch" {
+		t.Fatalf("seed regressed cached secret to a stale value: got %q", got.Data["k"])
+	}
+}
+
+func TestSecretReflectorStopRefCounting(t *testing.T) {
+	r := newSecretReflector(nil, "ns", "name", time.Minute, func(old, new *v1.Secret) {})
+	r.refCount = 2
+
+	if r.stop() {
+		t.Fatalf("stop() should not report removal while refCount > 0")
+	}
+	if !r.stop() {
+		t.Fatalf("stop() should report removal once refCount drops to zero")
+	}
+}
+
+// TestSecretReflectorStopFallBackPollingRace guards against the double-close
+// panic that used to occur when UnregisterPod's stop() raced the
+// access-check goroutine's fallBackToPolling(): both used to close runStopCh
+// independently, and whichever lost the race would close it twice.
+func TestSecretReflectorStopFallBackPollingRace(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		r := newSecretReflector(nil, "ns", "name", time.Minute, func(old, new *v1.Secret) {})
+		r.refCount = 1
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			r.fallBackToPolling()
+		}()
+		go func() {
+			defer wg.Done()
+			r.stop()
+		}()
+		wg.Wait()
+	}
+}